@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/gravitational/gravity/lib/loc"
+	"github.com/gravitational/gravity/lib/pack"
+
+	"github.com/gravitational/trace"
+)
+
+// fakePackages is a minimal in-memory pack.PackageService, just enough
+// to exercise repository logic (index CAS, verification, rebuild)
+// against real bytes without a running package service.
+type fakePackages struct {
+	mu       sync.Mutex
+	packages map[string]fakePackage
+}
+
+type fakePackage struct {
+	envelope pack.PackageEnvelope
+	data     []byte
+}
+
+func newFakePackages() *fakePackages {
+	return &fakePackages{packages: make(map[string]fakePackage)}
+}
+
+func (f *fakePackages) ReadPackage(locator loc.Locator) (*pack.PackageEnvelope, io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.packages[locator.String()]
+	if !ok {
+		return nil, nil, trace.NotFound("package %v not found", locator)
+	}
+	envelope := p.envelope
+	return &envelope, ioutil.NopCloser(bytes.NewReader(p.data)), nil
+}
+
+func (f *fakePackages) CreatePackage(locator loc.Locator, data io.Reader) (*pack.PackageEnvelope, error) {
+	f.mu.Lock()
+	if _, ok := f.packages[locator.String()]; ok {
+		f.mu.Unlock()
+		return nil, trace.AlreadyExists("package %v already exists", locator)
+	}
+	f.mu.Unlock()
+	return f.put(locator, data, 1)
+}
+
+func (f *fakePackages) UpsertPackage(locator loc.Locator, data io.Reader) (*pack.PackageEnvelope, error) {
+	f.mu.Lock()
+	generation := int64(1)
+	if p, ok := f.packages[locator.String()]; ok {
+		generation = p.envelope.Generation + 1
+	}
+	f.mu.Unlock()
+	return f.put(locator, data, generation)
+}
+
+func (f *fakePackages) CompareAndSwapPackage(locator loc.Locator, generation int64, data io.Reader) (*pack.PackageEnvelope, error) {
+	f.mu.Lock()
+	p, ok := f.packages[locator.String()]
+	if ok && p.envelope.Generation != generation {
+		f.mu.Unlock()
+		return nil, trace.CompareFailed("generation mismatch for %v", locator)
+	}
+	f.mu.Unlock()
+	return f.put(locator, data, generation+1)
+}
+
+func (f *fakePackages) DeletePackage(locator loc.Locator) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.packages[locator.String()]; !ok {
+		return trace.NotFound("package %v not found", locator)
+	}
+	delete(f.packages, locator.String())
+	return nil
+}
+
+func (f *fakePackages) GetPackages(repository string) ([]pack.PackageEnvelope, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var envelopes []pack.PackageEnvelope
+	for _, p := range f.packages {
+		if p.envelope.Locator.Repository == repository {
+			envelopes = append(envelopes, p.envelope)
+		}
+	}
+	return envelopes, nil
+}
+
+func (f *fakePackages) PortalURL() string {
+	return "https://gravity.local"
+}
+
+func (f *fakePackages) put(locator loc.Locator, data io.Reader, generation int64) (*pack.PackageEnvelope, error) {
+	payload, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	envelope := pack.PackageEnvelope{Locator: locator, Generation: generation}
+	f.packages[locator.String()] = fakePackage{envelope: envelope, data: payload}
+	return &envelope, nil
+}
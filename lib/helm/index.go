@@ -0,0 +1,396 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/gravitational/gravity/lib/defaults"
+	"github.com/gravitational/gravity/lib/loc"
+	"github.com/gravitational/gravity/lib/utils"
+
+	"github.com/cenkalti/backoff"
+	"github.com/ghodss/yaml"
+	"github.com/gravitational/trace"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/repo"
+)
+
+// rebuildWorkers bounds the number of charts RebuildIndex loads
+// concurrently, so a repository with many charts doesn't open
+// hundreds of package readers at once.
+const rebuildWorkers = 8
+
+// namesLoc stores the set of chart names that have had a shard written.
+// Only registerShardName reads and updates it; index reads and
+// RebuildIndex do not consult it.
+var namesLoc = loc.Locator{
+	Repository: "charts",
+	Name:       "index-names",
+	Version:    "0.0.1",
+}
+
+// shardLoc returns the locator of the per-chart-name index shard, which
+// holds only the entries for that one chart.
+func shardLoc(name string) (*loc.Locator, error) {
+	locator, err := loc.NewLocator("charts", fmt.Sprintf("index-%v", name), "0.0.1")
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return locator, nil
+}
+
+// upsertChartEntry adds or replaces the given chart version's entry in
+// its shard and keeps the merged root index in sync, retrying under
+// optimistic concurrency since multiple gravity-site pods can push
+// different charts at the same time.
+func (r *clusterRepository) upsertChartEntry(name string, version *repo.ChartVersion) error {
+	if err := r.updateShard(name, func(shard *repo.IndexFile) {
+		shard.Entries[name] = replaceVersion(shard.Entries[name], version)
+	}); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := r.registerShardName(name); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(r.refreshMergedIndex(name))
+}
+
+// removeChartEntry removes the given chart version from its shard and
+// the merged root index.
+func (r *clusterRepository) removeChartEntry(name, version string) error {
+	if err := r.updateShard(name, func(shard *repo.IndexFile) {
+		versions := shard.Entries[name]
+		for i, v := range versions {
+			if v.Version == version {
+				shard.Entries[name] = append(versions[:i], versions[i+1:]...)
+				break
+			}
+		}
+	}); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(r.refreshMergedIndex(name))
+}
+
+// updateShard applies mutate to the named chart's shard and writes it
+// back, retrying on a lost optimistic-concurrency race against another
+// writer of the same shard.
+func (r *clusterRepository) updateShard(name string, mutate func(*repo.IndexFile)) error {
+	locator, err := shardLoc(name)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = defaults.RebuildIndexTimeout
+	return utils.RetryTransient(context.TODO(), b, func() error {
+		shard, generation, err := r.readIndexFileCAS(*locator)
+		if err != nil && !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		if trace.IsNotFound(err) {
+			shard = repo.NewIndexFile()
+		}
+		mutate(shard)
+		shard.SortEntries()
+		return trace.Wrap(r.writeIndexFileCAS(*locator, generation, shard))
+	})
+}
+
+// refreshMergedIndex recomputes the root index.yaml from the shard for
+// name and the rest of the previously cached entries, so readers keep
+// seeing an up-to-date index without every writer re-marshaling every
+// other chart's entries.
+func (r *clusterRepository) refreshMergedIndex(name string) error {
+	shardLocator, err := shardLoc(name)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	shard, _, err := r.readIndexFileCAS(*shardLocator)
+	if err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = defaults.RebuildIndexTimeout
+	return utils.RetryTransient(context.TODO(), b, func() error {
+		merged, generation, err := r.readIndexFileCAS(indexLoc)
+		if err != nil && !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		if trace.IsNotFound(err) {
+			merged = repo.NewIndexFile()
+		}
+		if shard == nil || len(shard.Entries[name]) == 0 {
+			delete(merged.Entries, name)
+		} else {
+			merged.Entries[name] = shard.Entries[name]
+		}
+		merged.SortEntries()
+		return trace.Wrap(r.writeIndexFileCAS(indexLoc, generation, merged))
+	})
+}
+
+// registerShardName records name in the set of chart names that have a
+// shard, stored under namesLoc.
+func (r *clusterRepository) registerShardName(name string) error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = defaults.RebuildIndexTimeout
+	return utils.RetryTransient(context.TODO(), b, func() error {
+		names, generation, err := r.readNamesCAS()
+		if err != nil && !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		if containsName(names, name) {
+			return nil
+		}
+		names = append(names, name)
+		data, err := json.Marshal(names)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		_, err = r.Packages.CompareAndSwapPackage(namesLoc, generation, bytes.NewReader(data))
+		return trace.Wrap(err)
+	})
+}
+
+func (r *clusterRepository) readNamesCAS() (names []string, generation int64, err error) {
+	envelope, reader, err := r.Packages.ReadPackage(namesLoc)
+	if err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	return names, envelope.Generation, nil
+}
+
+// readIndexFileCAS reads and decodes an index.yaml-shaped package,
+// returning its generation for a subsequent compare-and-swap write.
+// This is also where the previous nil-pointer bug lived: the index file
+// must be allocated before being passed to yaml.Unmarshal.
+func (r *clusterRepository) readIndexFileCAS(locator loc.Locator) (*repo.IndexFile, int64, error) {
+	envelope, reader, err := r.Packages.ReadPackage(locator)
+	if err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	indexFile := repo.NewIndexFile()
+	if err := yaml.Unmarshal(data, indexFile); err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	return indexFile, envelope.Generation, nil
+}
+
+func (r *clusterRepository) writeIndexFileCAS(locator loc.Locator, generation int64, indexFile *repo.IndexFile) error {
+	data, err := yaml.Marshal(indexFile)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = r.Packages.CompareAndSwapPackage(locator, generation, bytes.NewReader(data))
+	return trace.Wrap(err)
+}
+
+// RebuildIndex regenerates every chart's index entry by loading its
+// package straight from storage and merging the result back into the
+// shard and root index through the same CAS path PutChart/DeleteChart
+// use, rather than overwriting them wholesale - so a push or delete that
+// lands while the rebuild is still walking packages is merged in instead
+// of clobbered. Use it to restore a lost root index or entries that were
+// silently dropped by a lost update under concurrent pushes. Entries are
+// only added or replaced, never removed, and a shard or root index that
+// cannot be parsed makes the rebuild fail.
+func (r *clusterRepository) RebuildIndex(ctx context.Context) error {
+	envelopes, err := r.Packages.GetPackages(chartsRepository)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	var mu sync.Mutex
+	byName := map[string][]*repo.ChartVersion{}
+	var collectErr error
+
+	jobs := make(chan loc.Locator)
+	var wg sync.WaitGroup
+	for i := 0; i < rebuildWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for locator := range jobs {
+				version, err := r.loadChartVersion(locator)
+				if err != nil {
+					mu.Lock()
+					if collectErr == nil {
+						collectErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				if version == nil {
+					continue
+				}
+				mu.Lock()
+				byName[locator.Name] = append(byName[locator.Name], version)
+				mu.Unlock()
+			}
+		}()
+	}
+loop:
+	for _, envelope := range envelopes {
+		if !isChartPackage(envelope.Locator) {
+			continue
+		}
+		select {
+		case jobs <- envelope.Locator:
+		case <-ctx.Done():
+			mu.Lock()
+			if collectErr == nil {
+				collectErr = ctx.Err()
+			}
+			mu.Unlock()
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if collectErr != nil {
+		return trace.Wrap(collectErr)
+	}
+
+	// Write each rescanned version back through upsertChartEntry rather
+	// than overwriting the shard/root index wholesale: upsertChartEntry
+	// CASes against the shard's and root index's current generation and
+	// retries on a lost race, so a PutChart/DeleteChart that lands on a
+	// name while RebuildIndex is still walking packages gets merged into
+	// the rebuilt shard instead of being silently clobbered by it.
+	for name, versions := range byName {
+		for _, version := range versions {
+			if err := r.upsertChartEntry(name, version); err != nil {
+				return trace.Wrap(err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadChartVersion reloads a single chart's index entry straight from
+// its persisted tarball, for RebuildIndex. The tarball bytes are just as
+// attacker-controlled here as they were on the original PutChart, so
+// this re-verifies provenance and overwrites the trust annotations
+// exactly like addToIndex does, rather than trusting whatever
+// Chart.yaml claims about itself.
+func (r *clusterRepository) loadChartVersion(locator loc.Locator) (*repo.ChartVersion, error) {
+	_, reader, err := r.Packages.ReadPackage(locator)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer reader.Close()
+	chart, err := chartutil.LoadArchive(reader)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	digest, err := r.digest(locator)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	_, verifyReader, err := r.Packages.ReadPackage(locator)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer verifyReader.Close()
+	signedBy, err := r.verifyChart(locator.Name, locator.Version, verifyReader)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	applyTrustAnnotations(chart.Metadata, signedBy)
+	version := &repo.ChartVersion{
+		Metadata: chart.Metadata,
+		Digest:   digest,
+		URLs: []string{fmt.Sprintf("%v/charts/%v-%v.tgz",
+			r.Packages.PortalURL(), chart.Metadata.Name, chart.Metadata.Version)},
+	}
+	return version, nil
+}
+
+func replaceVersion(versions []*repo.ChartVersion, version *repo.ChartVersion) []*repo.ChartVersion {
+	for i, v := range versions {
+		if v.Version == version.Version {
+			versions[i] = version
+			return versions
+		}
+	}
+	return append(versions, version)
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isChartPackage excludes the shards, cache and sidecar packages this
+// package itself stores under the charts repository from a chart tarball
+// walk.
+func isChartPackage(locator loc.Locator) bool {
+	switch {
+	case locator.Name == "index", locator.Name == "index-names":
+		return false
+	case hasAnySuffix(locator.Name, "-meta", "-manifest", ".prov"):
+		return false
+	case hasAnyPrefix(locator.Name, "index-"):
+		return false
+	case strings.Contains(locator.Name, "-blob-"):
+		return false
+	}
+	return true
+}
+
+func hasAnySuffix(s string, suffixes ...string) bool {
+	for _, suffix := range suffixes {
+		if len(s) >= len(suffix) && s[len(s)-len(suffix):] == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes ...string) bool {
+	for _, prefix := range prefixes {
+		if len(s) >= len(prefix) && s[:len(prefix)] == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+const chartsRepository = "charts"
@@ -0,0 +1,246 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/gravitational/gravity/lib/loc"
+
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestUpsertChartEntryAddsVersion(t *testing.T) {
+	r := &clusterRepository{Config: Config{Packages: newFakePackages()}}
+	version := &repo.ChartVersion{Metadata: &chart.Metadata{Name: "mychart", Version: "1.0.0"}}
+	if err := r.upsertChartEntry("mychart", version); err != nil {
+		t.Fatalf("upsertChartEntry failed: %v", err)
+	}
+	index, err := r.getIndexFile()
+	if err != nil {
+		t.Fatalf("getIndexFile failed: %v", err)
+	}
+	if len(index.Entries["mychart"]) != 1 || index.Entries["mychart"][0].Version != "1.0.0" {
+		t.Fatalf("expected mychart:1.0.0 in merged index, got %+v", index.Entries["mychart"])
+	}
+}
+
+func TestUpsertChartEntryReplacesExistingVersion(t *testing.T) {
+	r := &clusterRepository{Config: Config{Packages: newFakePackages()}}
+	v1 := &repo.ChartVersion{Metadata: &chart.Metadata{Name: "mychart", Version: "1.0.0"}, Digest: "aaa"}
+	v2 := &repo.ChartVersion{Metadata: &chart.Metadata{Name: "mychart", Version: "1.0.0"}, Digest: "bbb"}
+	if err := r.upsertChartEntry("mychart", v1); err != nil {
+		t.Fatalf("first upsert failed: %v", err)
+	}
+	if err := r.upsertChartEntry("mychart", v2); err != nil {
+		t.Fatalf("second upsert failed: %v", err)
+	}
+	index, err := r.getIndexFile()
+	if err != nil {
+		t.Fatalf("getIndexFile failed: %v", err)
+	}
+	if len(index.Entries["mychart"]) != 1 || index.Entries["mychart"][0].Digest != "bbb" {
+		t.Fatalf("expected the replaced entry with digest bbb, got %+v", index.Entries["mychart"])
+	}
+}
+
+func TestRemoveChartEntryDropsVersion(t *testing.T) {
+	r := &clusterRepository{Config: Config{Packages: newFakePackages()}}
+	version := &repo.ChartVersion{Metadata: &chart.Metadata{Name: "mychart", Version: "1.0.0"}}
+	if err := r.upsertChartEntry("mychart", version); err != nil {
+		t.Fatalf("upsertChartEntry failed: %v", err)
+	}
+	if err := r.removeChartEntry("mychart", "1.0.0"); err != nil {
+		t.Fatalf("removeChartEntry failed: %v", err)
+	}
+	index, err := r.getIndexFile()
+	if err != nil {
+		t.Fatalf("getIndexFile failed: %v", err)
+	}
+	if len(index.Entries["mychart"]) != 0 {
+		t.Fatalf("expected mychart to have no versions left, got %+v", index.Entries["mychart"])
+	}
+}
+
+func TestRebuildIndexScansExistingCharts(t *testing.T) {
+	packages := newFakePackages()
+	r := &clusterRepository{Config: Config{Packages: packages}}
+	locator, err := loc.NewLocator("charts", "mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("NewLocator failed: %v", err)
+	}
+	if _, err := packages.CreatePackage(*locator, bytes.NewReader(buildTestChartTarball(t, "mychart", "1.0.0"))); err != nil {
+		t.Fatalf("CreatePackage failed: %v", err)
+	}
+
+	if err := r.RebuildIndex(context.Background()); err != nil {
+		t.Fatalf("RebuildIndex failed: %v", err)
+	}
+
+	index, err := r.getIndexFile()
+	if err != nil {
+		t.Fatalf("getIndexFile failed: %v", err)
+	}
+	if len(index.Entries["mychart"]) != 1 || index.Entries["mychart"][0].Version != "1.0.0" {
+		t.Fatalf("expected mychart:1.0.0 in the rebuilt index, got %+v", index.Entries["mychart"])
+	}
+}
+
+func TestRebuildIndexIgnoresSidecarPackages(t *testing.T) {
+	packages := newFakePackages()
+	r := &clusterRepository{Config: Config{Packages: packages}}
+	chartLoc, err := loc.NewLocator("charts", "mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("NewLocator failed: %v", err)
+	}
+	if _, err := packages.CreatePackage(*chartLoc, bytes.NewReader(buildTestChartTarball(t, "mychart", "1.0.0"))); err != nil {
+		t.Fatalf("CreatePackage failed: %v", err)
+	}
+	metaLoc, err := loc.NewLocator("charts", "mychart-meta", "1.0.0")
+	if err != nil {
+		t.Fatalf("NewLocator failed: %v", err)
+	}
+	if _, err := packages.CreatePackage(*metaLoc, bytes.NewReader([]byte("{}"))); err != nil {
+		t.Fatalf("CreatePackage failed: %v", err)
+	}
+
+	if err := r.RebuildIndex(context.Background()); err != nil {
+		t.Fatalf("RebuildIndex failed: %v", err)
+	}
+
+	index, err := r.getIndexFile()
+	if err != nil {
+		t.Fatalf("getIndexFile failed: %v", err)
+	}
+	if len(index.Entries) != 1 || len(index.Entries["mychart"]) != 1 {
+		t.Fatalf("expected only mychart:1.0.0 in the rebuilt index, got %+v", index.Entries)
+	}
+}
+
+func TestRebuildIndexClearsForgedVerificationAnnotations(t *testing.T) {
+	packages := newFakePackages()
+	r := &clusterRepository{Config: Config{Packages: packages}}
+	locator, err := loc.NewLocator("charts", "mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("NewLocator failed: %v", err)
+	}
+	body := buildTestChartTarballWithAnnotations(t, "mychart", "1.0.0", map[string]string{
+		annotationVerified: "true",
+		annotationSignedBy: "forged-key",
+	})
+	if _, err := packages.CreatePackage(*locator, bytes.NewReader(body)); err != nil {
+		t.Fatalf("CreatePackage failed: %v", err)
+	}
+
+	if err := r.RebuildIndex(context.Background()); err != nil {
+		t.Fatalf("RebuildIndex failed: %v", err)
+	}
+
+	index, err := r.getIndexFile()
+	if err != nil {
+		t.Fatalf("getIndexFile failed: %v", err)
+	}
+	entry := index.Entries["mychart"][0]
+	if entry.Metadata.Annotations[annotationVerified] != "false" {
+		t.Fatalf("expected forged verified annotation to be overwritten, got %+v", entry.Metadata.Annotations)
+	}
+	if _, ok := entry.Metadata.Annotations[annotationSignedBy]; ok {
+		t.Fatalf("expected forged signed-by annotation to be cleared, got %+v", entry.Metadata.Annotations)
+	}
+}
+
+func TestRebuildIndexPreservesConcurrentlyPushedVersion(t *testing.T) {
+	packages := newFakePackages()
+	r := &clusterRepository{Config: Config{Packages: packages}}
+	locator, err := loc.NewLocator("charts", "mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("NewLocator failed: %v", err)
+	}
+	if _, err := packages.CreatePackage(*locator, bytes.NewReader(buildTestChartTarball(t, "mychart", "1.0.0"))); err != nil {
+		t.Fatalf("CreatePackage failed: %v", err)
+	}
+
+	// Simulate a PutChart for a second version landing after RebuildIndex
+	// took its package snapshot (so the new version never reaches
+	// loadChartVersion) but before RebuildIndex finishes writing the
+	// shard back out.
+	if err := r.upsertChartEntry("mychart", &repo.ChartVersion{
+		Metadata: &chart.Metadata{Name: "mychart", Version: "2.0.0"},
+	}); err != nil {
+		t.Fatalf("upsertChartEntry failed: %v", err)
+	}
+
+	if err := r.RebuildIndex(context.Background()); err != nil {
+		t.Fatalf("RebuildIndex failed: %v", err)
+	}
+
+	index, err := r.getIndexFile()
+	if err != nil {
+		t.Fatalf("getIndexFile failed: %v", err)
+	}
+	if len(index.Entries["mychart"]) != 2 {
+		t.Fatalf("expected the concurrently pushed 2.0.0 to survive the rebuild, got %+v", index.Entries["mychart"])
+	}
+}
+
+// buildTestChartTarball returns the bytes of a minimal but valid Helm
+// chart tarball, good enough for chartutil.LoadArchive to parse.
+func buildTestChartTarball(t *testing.T, name, version string) []byte {
+	t.Helper()
+	return buildTestChartTarballWithAnnotations(t, name, version, nil)
+}
+
+// buildTestChartTarballWithAnnotations is buildTestChartTarball but lets
+// the caller bake arbitrary annotations into Chart.yaml, for exercising
+// how the repository handles attacker-controlled trust markers.
+func buildTestChartTarballWithAnnotations(t *testing.T, name, version string, annotations map[string]string) []byte {
+	t.Helper()
+	chartYAML := fmt.Sprintf("name: %v\nversion: %v\n", name, version)
+	if len(annotations) > 0 {
+		chartYAML += "annotations:\n"
+		for k, v := range annotations {
+			chartYAML += fmt.Sprintf("  %v: %q\n", k, v)
+		}
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	body := []byte(chartYAML)
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name + "/Chart.yaml",
+		Mode: 0644,
+		Size: int64(len(body)),
+	}); err != nil {
+		t.Fatalf("write tar header: %v", err)
+	}
+	if _, err := tw.Write(body); err != nil {
+		t.Fatalf("write tar body: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("close gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
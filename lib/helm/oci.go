@@ -0,0 +1,383 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gravitational/gravity/lib/loc"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/gorilla/mux"
+	"github.com/gravitational/trace"
+)
+
+// PushOCI uploads a chart manifest addressed by ref, an OCI reference of
+// the form <name>:<version>, storing the chart tarball (already uploaded
+// as a blob keyed by its digest via PutBlob, per the OCI Distribution
+// protocol) as a package alongside its manifest. The manifest is stored
+// under a package named for the chart name and version, not under its
+// content digest.
+func (r *clusterRepository) PushOCI(ref string, layers []ocispec.Descriptor) error {
+	name, version, err := parseOCIRef(ref)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	chartLayer, err := chartContentLayer(layers)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	blob, err := r.FetchBlob(name, string(chartLayer.Digest))
+	if err != nil {
+		return trace.Wrap(err, "chart content blob %v not uploaded before manifest", chartLayer.Digest)
+	}
+	defer blob.Close()
+	// Buffer the blob and verify it before CreatePackage, the same way
+	// and for the same reason as PutChart: CreatePackage rejects a
+	// second create of the same locator, so a chart that fails
+	// verification here must not already be durably stored, or a retried
+	// push with a corrected signature would find the name:version
+	// permanently wedged.
+	tmp, err := ioutil.TempFile("", "chart-*.tgz")
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, blob); err != nil {
+		return trace.Wrap(err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return trace.Wrap(err)
+	}
+	signedBy, err := r.verifyChart(name, version, tmp)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return trace.Wrap(err)
+	}
+	locator, err := loc.NewLocator("charts", name, version)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = r.Packages.CreatePackage(*locator, tmp)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	digest, err := r.digest(*locator)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	manifest := ocispec.Manifest{
+		Versioned: ocispec.Versioned{SchemaVersion: 2},
+		Config: ocispec.Descriptor{
+			MediaType: helmConfigMediaType,
+			Digest:    godigest.Digest(digestRef(digest)),
+		},
+		Layers: layers,
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	manifestLoc, err := loc.NewLocator("charts", manifestPackageName(name, version), "0.0.1")
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = r.Packages.UpsertPackage(*manifestLoc, strings.NewReader(string(manifestData)))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(r.addToIndex(*locator, signedBy))
+}
+
+// PutBlob stores data as a content-addressable OCI blob for name, keyed
+// by digest: the chart content layer PushOCI later reads back, as well as
+// any other blob a registry client PUTs ahead of the manifest (e.g. the
+// OCI config blob).
+func (r *clusterRepository) PutBlob(name, digest string, data io.Reader) error {
+	locator, err := blobLoc(name, digest)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = r.Packages.UpsertPackage(*locator, data)
+	return trace.Wrap(err)
+}
+
+// FetchBlob returns a previously stored OCI blob for name by digest.
+func (r *clusterRepository) FetchBlob(name, digest string) (io.ReadCloser, error) {
+	locator, err := blobLoc(name, digest)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	_, reader, err := r.Packages.ReadPackage(*locator)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return reader, nil
+}
+
+// PullOCI returns the chart tarball and its OCI manifest for the given
+// ref, an OCI reference of the form <name>:<version>.
+func (r *clusterRepository) PullOCI(ref string) (io.ReadCloser, ocispec.Manifest, error) {
+	name, version, err := parseOCIRef(ref)
+	if err != nil {
+		return nil, ocispec.Manifest{}, trace.Wrap(err)
+	}
+	manifestLoc, err := loc.NewLocator("charts", manifestPackageName(name, version), "0.0.1")
+	if err != nil {
+		return nil, ocispec.Manifest{}, trace.Wrap(err)
+	}
+	_, manifestReader, err := r.Packages.ReadPackage(*manifestLoc)
+	if err != nil {
+		return nil, ocispec.Manifest{}, trace.Wrap(err)
+	}
+	defer manifestReader.Close()
+	var manifest ocispec.Manifest
+	if err := json.NewDecoder(manifestReader).Decode(&manifest); err != nil {
+		return nil, ocispec.Manifest{}, trace.Wrap(err)
+	}
+	chart, err := r.FetchChart(name, version)
+	if err != nil {
+		return nil, ocispec.Manifest{}, trace.Wrap(err)
+	}
+	return chart, manifest, nil
+}
+
+// NewOCIHandler returns an http.Handler that implements a subset of the
+// OCI Distribution v2 protocol backed by the provided repository, enough
+// for `helm pull oci://` and `helm push` to operate against it.
+func NewOCIHandler(repository Repository) http.Handler {
+	router := mux.NewRouter()
+	h := &ociHandler{repository: repository}
+	router.HandleFunc("/v2/", h.ping).Methods(http.MethodGet)
+	router.HandleFunc("/v2/_catalog", h.catalog).Methods(http.MethodGet)
+	router.HandleFunc("/v2/{name}/manifests/{ref}", h.getManifest).Methods(http.MethodGet)
+	router.HandleFunc("/v2/{name}/manifests/{ref}", h.putManifest).Methods(http.MethodPut)
+	// The upload-session routes do not overlap the digest-addressed blob
+	// routes below: {digest} matches a single path segment with no
+	// trailing slash, so neither "uploads/" nor "uploads/{uuid}" reaches it.
+	router.HandleFunc("/v2/{name}/blobs/uploads/", h.startBlobUpload).Methods(http.MethodPost)
+	router.HandleFunc("/v2/{name}/blobs/uploads/{uuid}", h.completeBlobUpload).Methods(http.MethodPut)
+	router.HandleFunc("/v2/{name}/blobs/{digest}", h.getBlob).Methods(http.MethodGet)
+	router.HandleFunc("/v2/{name}/blobs/{digest}", h.putBlob).Methods(http.MethodPut)
+	return router
+}
+
+type ociHandler struct {
+	repository Repository
+}
+
+func (h *ociHandler) ping(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+	w.WriteHeader(http.StatusOK)
+}
+
+// catalogResponse is the OCI Distribution v2 response shape for
+// GET /v2/_catalog.
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+func (h *ociHandler) catalog(w http.ResponseWriter, r *http.Request) {
+	names, err := h.repository.ListChartNames()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalogResponse{Repositories: names})
+}
+
+func (h *ociHandler) getManifest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	// PullOCI also opens the chart tarball to satisfy its return
+	// signature, but a manifest request only needs the manifest -
+	// close the chart reader immediately instead of leaking it.
+	chart, manifest, err := h.repository.PullOCI(fmt.Sprintf("%v:%v", vars["name"], vars["ref"]))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	chart.Close()
+	w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+func (h *ociHandler) putManifest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var manifest ocispec.Manifest
+	if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.repository.PushOCI(fmt.Sprintf("%v:%v", vars["name"], vars["ref"]), manifest.Layers); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *ociHandler) getBlob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	blob, err := h.repository.FetchBlob(vars["name"], vars["digest"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer blob.Close()
+	io.Copy(w, blob)
+}
+
+func (h *ociHandler) putBlob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := h.repository.PutBlob(vars["name"], vars["digest"], r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// startBlobUpload handles POST /v2/{name}/blobs/uploads/, the first step
+// a spec-compliant client (including the containerd distribution client
+// `helm push oci://` is built on) takes before PUTting a blob - it never
+// PUTs directly to /blobs/{digest} unprompted. It supports both shapes
+// the spec allows: a monolithic upload that attaches ?digest= and the
+// full blob to this same POST, and the two-step case, where it hands
+// back an upload session Location for a following PUT to
+// completeBlobUpload.
+func (h *ociHandler) startBlobUpload(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if digest := r.URL.Query().Get("digest"); digest != "" {
+		if err := h.repository.PutBlob(name, digest, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%v/blobs/%v", name, digest))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	uploadUUID, err := newUploadUUID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%v/blobs/uploads/%v", name, uploadUUID))
+	w.Header().Set("Docker-Upload-UUID", uploadUUID)
+	w.Header().Set("Range", "0-0")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// completeBlobUpload handles PUT /v2/{name}/blobs/uploads/{uuid}, the
+// second step of the upload session startBlobUpload began: the client
+// streams the blob here and supplies its digest as a query parameter, per
+// the OCI Distribution spec's monolithic-PUT-to-close-a-session form.
+func (h *ociHandler) completeBlobUpload(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	digest := r.URL.Query().Get("digest")
+	if digest == "" {
+		http.Error(w, "digest query parameter is required to complete an upload", http.StatusBadRequest)
+		return
+	}
+	if err := h.repository.PutBlob(name, digest, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%v/blobs/%v", name, digest))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// newUploadUUID returns a random identifier for an upload session. It
+// need not be persisted anywhere: completeBlobUpload trusts the digest
+// supplied on the closing PUT, the same way putBlob always has, so the
+// UUID only has to round-trip back on that one request.
+func newUploadUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+const helmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+
+// helmChartContentMediaType is the OCI media type `helm push oci://`
+// uses for the layer holding the chart tarball itself, as opposed to
+// the config blob.
+const helmChartContentMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+// chartContentLayer picks the manifest layer holding the chart tarball
+// out of layers. Real `helm push oci://` clients only ever upload the
+// one chart layer alongside the config blob, so a manifest with exactly
+// one layer is assumed to be that layer even without the media type set.
+func chartContentLayer(layers []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	for _, layer := range layers {
+		if layer.MediaType == helmChartContentMediaType {
+			return layer, nil
+		}
+	}
+	if len(layers) == 1 {
+		return layers[0], nil
+	}
+	return ocispec.Descriptor{}, trace.BadParameter("manifest has no chart content layer")
+}
+
+func manifestPackageName(name, version string) string {
+	return fmt.Sprintf("%v-%v-manifest", name, version)
+}
+
+func digestRef(digest string) string {
+	if strings.HasPrefix(digest, "sha256:") {
+		return digest
+	}
+	return fmt.Sprintf("sha256:%v", digest)
+}
+
+// blobLoc returns the locator an OCI blob is stored under, addressed by
+// its content digest rather than a chart name/version pair, mirroring
+// manifestPackageName's use of a synthetic package name for a non-chart
+// sidecar artifact.
+func blobLoc(name, digest string) (*loc.Locator, error) {
+	locator, err := loc.NewLocator("charts", fmt.Sprintf("%v-blob-%v", name, sanitizeDigest(digest)), "0.0.1")
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return locator, nil
+}
+
+func sanitizeDigest(digest string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(digest, "sha256:"), ":", "-")
+}
+
+func parseOCIRef(ref string) (name, version string, err error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return "", "", trace.BadParameter("bad OCI reference %q, expected <name>:<version>", ref)
+	}
+	return parts[0], parts[1], nil
+}
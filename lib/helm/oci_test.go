@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPushOCIPullOCIRoundTrip(t *testing.T) {
+	r := &clusterRepository{Config: Config{Packages: newFakePackages()}}
+	body := buildTestChartTarball(t, "mychart", "1.0.0")
+	const layerDigest = "sha256:deadbeef"
+	if err := r.PutBlob("mychart", layerDigest, bytes.NewReader(body)); err != nil {
+		t.Fatalf("PutBlob failed: %v", err)
+	}
+	layers := []ocispec.Descriptor{{
+		MediaType: helmChartContentMediaType,
+		Digest:    layerDigest,
+		Size:      int64(len(body)),
+	}}
+
+	if err := r.PushOCI("mychart:1.0.0", layers); err != nil {
+		t.Fatalf("PushOCI failed: %v", err)
+	}
+
+	chartReader, manifest, err := r.PullOCI("mychart:1.0.0")
+	if err != nil {
+		t.Fatalf("PullOCI failed: %v", err)
+	}
+	defer chartReader.Close()
+	pulled, err := ioutil.ReadAll(chartReader)
+	if err != nil {
+		t.Fatalf("reading pulled chart failed: %v", err)
+	}
+	if !bytes.Equal(pulled, body) {
+		t.Fatalf("expected the pulled chart bytes to match what was pushed")
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != layerDigest {
+		t.Fatalf("expected the manifest to record the pushed layer, got %+v", manifest.Layers)
+	}
+	if manifest.Config.MediaType != helmConfigMediaType {
+		t.Fatalf("expected config media type %v, got %v", helmConfigMediaType, manifest.Config.MediaType)
+	}
+}
+
+func TestPushOCIFailsWithoutUploadedBlob(t *testing.T) {
+	r := &clusterRepository{Config: Config{Packages: newFakePackages()}}
+	layers := []ocispec.Descriptor{{
+		MediaType: helmChartContentMediaType,
+		Digest:    "sha256:neverpushed",
+	}}
+	if err := r.PushOCI("mychart:1.0.0", layers); err == nil {
+		t.Fatal("expected PushOCI to fail when its chart content blob was never uploaded")
+	}
+}
+
+func TestChartContentLayerPrefersExplicitMediaType(t *testing.T) {
+	want := ocispec.Descriptor{MediaType: helmChartContentMediaType, Digest: "sha256:chart"}
+	layers := []ocispec.Descriptor{
+		{MediaType: helmConfigMediaType, Digest: "sha256:config"},
+		want,
+	}
+	got, err := chartContentLayer(layers)
+	if err != nil {
+		t.Fatalf("chartContentLayer failed: %v", err)
+	}
+	if got.Digest != want.Digest {
+		t.Fatalf("expected the layer with the chart content media type, got %+v", got)
+	}
+}
+
+func TestChartContentLayerFallsBackToSoleLayer(t *testing.T) {
+	want := ocispec.Descriptor{Digest: "sha256:onlylayer"}
+	got, err := chartContentLayer([]ocispec.Descriptor{want})
+	if err != nil {
+		t.Fatalf("chartContentLayer failed: %v", err)
+	}
+	if got.Digest != want.Digest {
+		t.Fatalf("expected the sole layer to be assumed as the chart content, got %+v", got)
+	}
+}
+
+func TestChartContentLayerRejectsAmbiguousLayers(t *testing.T) {
+	layers := []ocispec.Descriptor{
+		{Digest: "sha256:one"},
+		{Digest: "sha256:two"},
+	}
+	if _, err := chartContentLayer(layers); err == nil {
+		t.Fatal("expected an error when multiple layers exist with no media type to disambiguate them")
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gravitational/gravity/lib/loc"
+
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+
+	"github.com/gravitational/trace"
+	"github.com/sirupsen/logrus"
+)
+
+// ChartDetails contains everything about a chart version that a UI needs
+// to render it without re-downloading and unpacking the tarball.
+type ChartDetails struct {
+	// Readme is the contents of the chart's README.md as stored in the
+	// chart, if any; the markdown is not rendered.
+	Readme string `json:"readme,omitempty"`
+	// Values is the raw contents of the chart's values.yaml.
+	Values string `json:"values,omitempty"`
+	// Icon is the icon URL from Chart.yaml.
+	Icon string `json:"icon,omitempty"`
+	// Maintainers lists the chart's maintainers from Chart.yaml.
+	Maintainers []*chart.Maintainer `json:"maintainers,omitempty"`
+	// Templates lists the paths of all templates contained in the chart.
+	Templates []string `json:"templates,omitempty"`
+	// Dependencies is the chart's dependency graph as described by
+	// requirements.yaml.
+	Dependencies []*chartutil.Dependency `json:"dependencies,omitempty"`
+	// Labels are computed characteristics of the chart, e.g. whether it
+	// deploys a system component or manages stateful data.
+	Labels map[string]bool `json:"labels,omitempty"`
+}
+
+// ChartVersionDetail pairs a chart version with its details, as returned
+// by ListChartVersions.
+type ChartVersionDetail struct {
+	// Version is the chart version, e.g. "1.2.3".
+	Version string `json:"version"`
+	// Details is the extracted metadata for this version.
+	Details *ChartDetails `json:"details"`
+}
+
+// ChartOperator extracts and caches rich chart metadata that goes beyond
+// what a repo.IndexFile entry carries, mirroring Harbor's chartserver
+// operator.
+type ChartOperator struct {
+	repository *clusterRepository
+}
+
+// NewChartOperator returns a ChartOperator backed by the given repository.
+func NewChartOperator(repository *clusterRepository) *ChartOperator {
+	return &ChartOperator{repository: repository}
+}
+
+// Extract loads the chart tarball and computes its ChartDetails, caching
+// the result as a companion package next to the chart itself.
+func (o *ChartOperator) Extract(name, version string, data io.Reader) (*ChartDetails, error) {
+	var buf bytes.Buffer
+	loadedChart, err := chartutil.LoadArchive(io.TeeReader(data, &buf))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	details := &ChartDetails{
+		Icon:        loadedChart.Metadata.Icon,
+		Maintainers: loadedChart.Metadata.Maintainers,
+		Labels:      map[string]bool{},
+	}
+	for _, f := range loadedChart.Templates {
+		details.Templates = append(details.Templates, f.Name)
+	}
+	for _, f := range loadedChart.Files {
+		switch f.TypeUrl {
+		case "README.md":
+			details.Readme = string(f.Value)
+		}
+	}
+	if loadedChart.Values != nil {
+		details.Values = loadedChart.Values.Raw
+	}
+	requirements, err := chartutil.LoadRequirements(loadedChart)
+	if err != nil && !isRequirementsNotFound(err) {
+		return nil, trace.Wrap(err)
+	}
+	if requirements != nil {
+		details.Dependencies = requirements.Dependencies
+	}
+	details.Labels["system"] = hasAnnotation(loadedChart.Metadata, "gravitational.io/system")
+	details.Labels["stateful"] = hasStatefulDependency(details.Dependencies) ||
+		hasAnnotation(loadedChart.Metadata, "gravitational.io/stateful")
+
+	locator, err := metaLocator(name, version)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	payload, err := json.Marshal(details)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	_, err = o.repository.Packages.UpsertPackage(*locator, bytes.NewReader(payload))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return details, nil
+}
+
+// Get returns the cached ChartDetails for the given chart version.
+func (o *ChartOperator) Get(name, version string) (*ChartDetails, error) {
+	locator, err := metaLocator(name, version)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	_, reader, err := o.repository.Packages.ReadPackage(*locator)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer reader.Close()
+	var details ChartDetails
+	if err := json.NewDecoder(reader).Decode(&details); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &details, nil
+}
+
+// GetChartDetails returns the rich metadata for the given chart version,
+// extracting and caching it on demand if it hasn't been computed yet.
+func (r *clusterRepository) GetChartDetails(name, version string) (*ChartDetails, error) {
+	operator := r.operator()
+	details, err := operator.Get(name, version)
+	if err == nil {
+		return details, nil
+	}
+	if !trace.IsNotFound(err) {
+		return nil, trace.Wrap(err)
+	}
+	chartReader, err := r.FetchChart(name, version)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer chartReader.Close()
+	return operator.Extract(name, version, chartReader)
+}
+
+// ListChartVersions returns the details of every known version of the
+// named chart, in the order they appear in the repository index.
+// Versions whose details cannot be loaded are logged and left out.
+func (r *clusterRepository) ListChartVersions(name string) ([]ChartVersionDetail, error) {
+	indexFile, err := r.getIndexFile()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	versions, ok := indexFile.Entries[name]
+	if !ok {
+		return nil, trace.NotFound("chart %v not found", name)
+	}
+	result := make([]ChartVersionDetail, 0, len(versions))
+	for _, version := range versions {
+		details, err := r.GetChartDetails(name, version.Version)
+		if err != nil {
+			// Metadata extraction is a best-effort cache, same rationale
+			// as PutChart not failing the push over it - skip the one bad
+			// version rather than failing the whole chart's listing.
+			logrus.WithError(err).Warnf("Failed to get chart details for %v:%v.", name, version.Version)
+			continue
+		}
+		result = append(result, ChartVersionDetail{
+			Version: version.Version,
+			Details: details,
+		})
+	}
+	return result, nil
+}
+
+func (r *clusterRepository) operator() *ChartOperator {
+	return NewChartOperator(r)
+}
+
+func metaLocator(name, version string) (*loc.Locator, error) {
+	locator, err := loc.NewLocator("charts", fmt.Sprintf("%v-meta", name), version)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return locator, nil
+}
+
+func hasAnnotation(metadata *chart.Metadata, key string) bool {
+	if metadata == nil || metadata.Annotations == nil {
+		return false
+	}
+	return metadata.Annotations[key] == "true"
+}
+
+func hasStatefulDependency(deps []*chartutil.Dependency) bool {
+	for _, dep := range deps {
+		if dep.Name == "mysql" || dep.Name == "postgresql" || dep.Name == "etcd" {
+			return true
+		}
+	}
+	return false
+}
+
+func isRequirementsNotFound(err error) bool {
+	return err != nil && err.Error() == chartutil.ErrRequirementsNotFound.Error()
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gravitational/gravity/lib/loc"
+
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestExtractComputesDetailsAndCachesThem(t *testing.T) {
+	r := &clusterRepository{Config: Config{Packages: newFakePackages()}}
+	body := buildTestChartTarballWithAnnotations(t, "mychart", "1.0.0", map[string]string{
+		"gravitational.io/system": "true",
+	})
+	details, err := r.operator().Extract("mychart", "1.0.0", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if !details.Labels["system"] {
+		t.Fatalf("expected the system annotation to be reflected in Labels, got %+v", details.Labels)
+	}
+	cached, err := r.operator().Get("mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("Get failed after Extract: %v", err)
+	}
+	if cached.Labels["system"] != details.Labels["system"] {
+		t.Fatalf("expected cached details to match extracted details, got %+v vs %+v", cached, details)
+	}
+}
+
+func TestGetReturnsNotFoundWithoutExtract(t *testing.T) {
+	r := &clusterRepository{Config: Config{Packages: newFakePackages()}}
+	_, err := r.operator().Get("mychart", "1.0.0")
+	if err == nil {
+		t.Fatal("expected an error reading an un-extracted chart's details")
+	}
+}
+
+func TestGetChartDetailsExtractsOnCacheMiss(t *testing.T) {
+	packages := newFakePackages()
+	r := &clusterRepository{Config: Config{Packages: packages}}
+	locator, err := loc.NewLocator("charts", "mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("NewLocator failed: %v", err)
+	}
+	body := buildTestChartTarball(t, "mychart", "1.0.0")
+	if _, err := packages.CreatePackage(*locator, bytes.NewReader(body)); err != nil {
+		t.Fatalf("CreatePackage failed: %v", err)
+	}
+
+	details, err := r.GetChartDetails("mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("GetChartDetails failed: %v", err)
+	}
+	if details == nil {
+		t.Fatal("expected non-nil details")
+	}
+	if _, err := r.operator().Get("mychart", "1.0.0"); err != nil {
+		t.Fatalf("expected GetChartDetails to have cached the result, Get failed: %v", err)
+	}
+}
+
+func TestListChartVersionsSkipsVersionsThatFailExtraction(t *testing.T) {
+	packages := newFakePackages()
+	r := &clusterRepository{Config: Config{Packages: packages}}
+
+	goodLocator, err := loc.NewLocator("charts", "mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("NewLocator failed: %v", err)
+	}
+	body := buildTestChartTarball(t, "mychart", "1.0.0")
+	if _, err := packages.CreatePackage(*goodLocator, bytes.NewReader(body)); err != nil {
+		t.Fatalf("CreatePackage failed: %v", err)
+	}
+
+	// "2.0.0" is recorded in the index but its package was never
+	// created, so GetChartDetails will fail to fetch the chart tarball -
+	// ListChartVersions must skip it rather than failing the whole call.
+	if err := r.upsertChartEntry("mychart", &repo.ChartVersion{
+		Metadata: &chart.Metadata{Name: "mychart", Version: "1.0.0"},
+	}); err != nil {
+		t.Fatalf("upsertChartEntry failed: %v", err)
+	}
+	if err := r.upsertChartEntry("mychart", &repo.ChartVersion{
+		Metadata: &chart.Metadata{Name: "mychart", Version: "2.0.0"},
+	}); err != nil {
+		t.Fatalf("upsertChartEntry failed: %v", err)
+	}
+
+	versions, err := r.ListChartVersions("mychart")
+	if err != nil {
+		t.Fatalf("ListChartVersions failed: %v", err)
+	}
+	if len(versions) != 1 || versions[0].Version != "1.0.0" {
+		t.Fatalf("expected only 1.0.0 to survive, got %+v", versions)
+	}
+}
@@ -17,13 +17,14 @@ limitations under the License.
 package helm
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
 
 	"github.com/gravitational/gravity/lib/loc"
 	"github.com/gravitational/gravity/lib/pack"
@@ -32,8 +33,10 @@ import (
 	"k8s.io/helm/pkg/provenance"
 	"k8s.io/helm/pkg/repo"
 
-	"github.com/ghodss/yaml"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
 	"github.com/gravitational/trace"
+	"github.com/sirupsen/logrus"
 )
 
 // Repository defines a Helm repository interface.
@@ -42,15 +45,49 @@ type Repository interface {
 	GetIndexFile() (io.ReadCloser, error)
 	PutChart(chartName, chartVersion string, data io.Reader) error
 	DeleteChart(chartName, chartVersion string) error
+	// PushOCI creates a chart from the tarball blob referenced by layers
+	// (already uploaded via PutBlob) under an OCI Distribution reference
+	// of the form <name>:<version>, for `helm push oci://`.
+	PushOCI(ref string, layers []ocispec.Descriptor) error
+	// PullOCI fetches a chart and its OCI manifest by reference, for
+	// `helm pull oci://`.
+	PullOCI(ref string) (io.ReadCloser, ocispec.Manifest, error)
+	// PutProvenance stores a detached provenance file for the given
+	// chart version.
+	PutProvenance(name, version string, sig io.Reader) error
+	// FetchProvenance returns the provenance file for the given chart
+	// version, if one was uploaded.
+	FetchProvenance(name, version string) (io.ReadCloser, error)
+	// PutBlob stores a content-addressable OCI blob for the named
+	// repository, keyed by its digest.
+	PutBlob(name, digest string, data io.Reader) error
+	// FetchBlob returns a previously stored OCI blob by digest.
+	FetchBlob(name, digest string) (io.ReadCloser, error)
+	// GetChartDetails returns rich metadata for the given chart version,
+	// extracting it from the tarball if it hasn't been cached yet.
+	GetChartDetails(name, version string) (*ChartDetails, error)
+	// ListChartVersions returns rich metadata for the known versions of
+	// the named chart; versions whose metadata cannot be loaded are
+	// skipped.
+	ListChartVersions(name string) ([]ChartVersionDetail, error)
+	// ListChartNames returns the names of every chart in the repository,
+	// for the OCI Distribution v2 /v2/_catalog endpoint.
+	ListChartNames() ([]string, error)
+	// RebuildIndex reloads every chart in the repository and upserts its
+	// entry into the chart index shards and cached root index. Existing
+	// entries without a stored chart are kept.
+	RebuildIndex(ctx context.Context) error
 }
 
 type Config struct {
 	Packages pack.PackageService
+	// Signing configures chart signature verification. If unset, charts
+	// are accepted without verifying provenance.
+	Signing *SigningConfig
 }
 
 type clusterRepository struct {
 	Config
-	sync.Mutex
 }
 
 func NewRepository(config Config) (*clusterRepository, error) {
@@ -64,6 +101,9 @@ func (r *clusterRepository) FetchChart(chartName, chartVersion string) (io.ReadC
 	// if err != nil {
 	// 	return nil, trace.Wrap(err)
 	// }
+	if err := r.checkVerified(chartName, chartVersion); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	locator, err := loc.NewLocator("charts", chartName, chartVersion)
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -75,59 +115,92 @@ func (r *clusterRepository) FetchChart(chartName, chartVersion string) (io.ReadC
 	return reader, nil
 }
 
+// checkVerified refuses to serve a chart the index does not record as
+// signature-verified, once the repository is configured to require it -
+// so a chart that was pushed before signing was turned on cannot be
+// fetched. It trusts the status recorded when the chart was pushed or
+// last rebuilt; the provenance file is not re-verified on fetch.
+func (r *clusterRepository) checkVerified(name, version string) error {
+	if r.Signing == nil || r.Signing.KeyringPath == "" || r.Signing.AllowUnsigned {
+		return nil
+	}
+	index, err := r.getIndexFile()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, v := range index.Entries[name] {
+		if v.Version != version {
+			continue
+		}
+		if v.Metadata != nil && v.Metadata.Annotations[annotationVerified] == "true" {
+			return nil
+		}
+		return trace.BadParameter("chart %v:%v is not signature-verified", name, version)
+	}
+	return trace.NotFound("chart %v:%v not found in index", name, version)
+}
+
 func (r *clusterRepository) GetIndexFile() (io.ReadCloser, error) {
 	_, reader, err := r.Packages.ReadPackage(indexLoc)
 	return reader, trace.Wrap(err)
 }
 
 func (r *clusterRepository) PutChart(name, version string, data io.Reader) error {
-	locator, err := loc.NewLocator("charts", name, version)
+	// Buffer the upload so it can be verified before anything is
+	// durably created under this name/version - CreatePackage rejects a
+	// second create of the same locator, so verifying first means a
+	// rejected push (bad/unknown signature) can simply be retried with a
+	// corrected signature instead of wedging the version permanently.
+	tmp, err := ioutil.TempFile("", "chart-*.tgz")
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	_, err = r.Packages.CreatePackage(*locator, data)
-	if err != nil {
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, data); err != nil {
 		return trace.Wrap(err)
 	}
-	err = r.addToIndex(*locator)
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return trace.Wrap(err)
+	}
+	signedBy, err := r.verifyChart(name, version, tmp)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	return nil
-}
-
-func (r *clusterRepository) removeFromIndex(chartName, chartVersion string) error {
-	r.Lock()
-	defer r.Unlock()
-	indexFile, err := r.getIndexFile()
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return trace.Wrap(err)
+	}
+	locator, err := loc.NewLocator("charts", name, version)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	for name, versions := range indexFile.Entries {
-		if name == chartName {
-			for i, version := range versions {
-				if version.Version == chartVersion {
-					indexFile.Entries[name] = append(
-						versions[:i], versions[i+1:]...)
-					break
-				}
-			}
-		}
+	_, err = r.Packages.CreatePackage(*locator, tmp)
+	if err != nil {
+		return trace.Wrap(err)
 	}
-	data, err := yaml.Marshal(indexFile)
+	err = r.addToIndex(*locator, signedBy)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	_, err = r.Packages.UpsertPackage(indexLoc, bytes.NewReader(data))
+	_, metaReader, err := r.Packages.ReadPackage(*locator)
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	defer metaReader.Close()
+	// Rich metadata is a cache on top of the real repository, not a hard
+	// dependency of it - a chart that's already durably created and
+	// indexed shouldn't be reported as failed to the client just because
+	// this enrichment step choked on it (e.g. an edge-case values.yaml).
+	if _, err := r.operator().Extract(name, version, metaReader); err != nil {
+		logrus.WithError(err).Warnf("Failed to extract chart metadata for %v:%v.", name, version)
+	}
 	return nil
 }
 
-func (r *clusterRepository) addToIndex(locator loc.Locator) error {
-	r.Lock()
-	defer r.Unlock()
+// addToIndex loads the chart tarball at locator, builds its index entry
+// (annotated with its provenance verification status) and
+// upserts it into the chart's shard and the cached root index.
+func (r *clusterRepository) addToIndex(locator loc.Locator, signedBy string) error {
 	_, reader, err := r.Packages.ReadPackage(locator)
 	if err != nil {
 		return trace.Wrap(err)
@@ -137,34 +210,30 @@ func (r *clusterRepository) addToIndex(locator loc.Locator) error {
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	digest, err := r.digest(locator)
-	if err != nil {
-		return trace.Wrap(err)
-	}
-	indexFile, err := r.getIndexFile()
+	existing, err := r.getIndexFile()
 	if err != nil && !trace.IsNotFound(err) {
 		return trace.Wrap(err)
 	}
-	if trace.IsNotFound(err) {
-		indexFile = repo.NewIndexFile()
-	}
-	if indexFile.Has(chart.Metadata.Name, chart.Metadata.Version) {
+	if err == nil && existing.Has(chart.Metadata.Name, chart.Metadata.Version) {
 		return trace.AlreadyExists("chart %v:%v already exists",
 			chart.Metadata.Name, chart.Metadata.Version)
 	}
-	indexFile.Add(chart.Metadata, fmt.Sprintf("%v-%v.tgz",
-		chart.Metadata.Name, chart.Metadata.Version), filepath.Join(
-		r.Packages.PortalURL(), "charts"), digest)
-	indexFile.SortEntries()
-	data, err := yaml.Marshal(indexFile)
+	digest, err := r.digest(locator)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	_, err = r.Packages.UpsertPackage(indexLoc, bytes.NewReader(data))
-	if err != nil {
-		return trace.Wrap(err)
+	// The chart's own Chart.yaml is attacker-controlled, so its
+	// Annotations map cannot be trusted as-is: always overwrite the trust
+	// markers with the real verification outcome, clearing any forged
+	// "verified"/"signed-by" values a chart author baked in themselves.
+	applyTrustAnnotations(chart.Metadata, signedBy)
+	version := &repo.ChartVersion{
+		Metadata: chart.Metadata,
+		Digest:   digest,
+		URLs: []string{fmt.Sprintf("%v/%v-%v.tgz", filepath.Join(
+			r.Packages.PortalURL(), "charts"), chart.Metadata.Name, chart.Metadata.Version)},
 	}
-	return nil
+	return trace.Wrap(r.upsertChartEntry(chart.Metadata.Name, version))
 }
 
 func (r *clusterRepository) digest(locator loc.Locator) (string, error) {
@@ -180,22 +249,30 @@ func (r *clusterRepository) digest(locator loc.Locator) (string, error) {
 	return digest, nil
 }
 
+// getIndexFile returns the cached merged index. It is regenerated
+// incrementally as charts are pushed and removed, and its entries for
+// stored charts can be restored with RebuildIndex if it's ever lost.
 func (r *clusterRepository) getIndexFile() (*repo.IndexFile, error) {
-	_, reader, err := r.Packages.ReadPackage(indexLoc)
+	indexFile, _, err := r.readIndexFileCAS(indexLoc)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	defer reader.Close()
-	data, err := ioutil.ReadAll(reader)
+	return indexFile, nil
+}
+
+// ListChartNames returns the names of every chart in the repository, in
+// alphabetical order, for the OCI Distribution v2 catalog endpoint.
+func (r *clusterRepository) ListChartNames() ([]string, error) {
+	index, err := r.getIndexFile()
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	var indexFile *repo.IndexFile
-	err = yaml.Unmarshal(data, indexFile)
-	if err != nil {
-		return nil, trace.Wrap(err)
+	names := make([]string, 0, len(index.Entries))
+	for name := range index.Entries {
+		names = append(names, name)
 	}
-	return indexFile, nil
+	sort.Strings(names)
+	return names, nil
 }
 
 func (r *clusterRepository) DeleteChart(chartName, chartVersion string) error {
@@ -203,7 +280,7 @@ func (r *clusterRepository) DeleteChart(chartName, chartVersion string) error {
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	err = r.removeFromIndex(chartName, chartVersion)
+	err = r.removeChartEntry(chartName, chartVersion)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gravitational/trace"
+)
+
+func TestVerifyChartNoopWithoutSigningConfig(t *testing.T) {
+	r := &clusterRepository{Config: Config{Packages: newFakePackages()}}
+	signedBy, err := r.verifyChart("mychart", "1.0.0", strings.NewReader("chart-bytes"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if signedBy != "" {
+		t.Fatalf("expected empty signer, got %q", signedBy)
+	}
+}
+
+func TestVerifyChartAllowsUnsignedWithoutProvenance(t *testing.T) {
+	r := &clusterRepository{Config: Config{
+		Packages: newFakePackages(),
+		Signing: &SigningConfig{
+			KeyringPath:   "/does/not/matter",
+			AllowUnsigned: true,
+		},
+	}}
+	signedBy, err := r.verifyChart("mychart", "1.0.0", strings.NewReader("chart-bytes"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if signedBy != "" {
+		t.Fatalf("expected empty signer, got %q", signedBy)
+	}
+}
+
+func TestVerifyChartRejectsMissingProvenance(t *testing.T) {
+	r := &clusterRepository{Config: Config{
+		Packages: newFakePackages(),
+		Signing: &SigningConfig{
+			KeyringPath: "/does/not/matter",
+		},
+	}}
+	_, err := r.verifyChart("mychart", "1.0.0", strings.NewReader("chart-bytes"))
+	if err == nil {
+		t.Fatal("expected an error for a chart with no provenance file and AllowUnsigned unset")
+	}
+}
+
+func TestVerifyChartRejectsUnloadableKeyring(t *testing.T) {
+	packages := newFakePackages()
+	provLoc, err := provenanceLocator("mychart", "1.0.0")
+	if err != nil {
+		t.Fatalf("provenanceLocator failed: %v", err)
+	}
+	if _, err := packages.UpsertPackage(*provLoc, strings.NewReader("not-a-real-signature")); err != nil {
+		t.Fatalf("UpsertPackage failed: %v", err)
+	}
+	r := &clusterRepository{Config: Config{
+		Packages: packages,
+		Signing: &SigningConfig{
+			KeyringPath: "/does/not/exist",
+		},
+	}}
+	_, err = r.verifyChart("mychart", "1.0.0", strings.NewReader("chart-bytes"))
+	if err == nil {
+		t.Fatal("expected an error for a keyring that can't be loaded")
+	}
+	if trace.IsNotFound(err) {
+		t.Fatalf("expected a verification error, not a not-found error: %v", err)
+	}
+}
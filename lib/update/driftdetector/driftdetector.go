@@ -0,0 +1,328 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package driftdetector periodically compares the intended cluster state
+// described by the active storage.OperationPlan against what is actually
+// running on each node, and publishes persistent discrepancies as
+// storage.DriftEvent records for the API and UI to surface.
+//
+// Of the fields the plan describes, only leader election state
+// (serverFields' "election" entry) is compared against live node state.
+// Profiles and runtime/teleport package versions, which systemNeedsUpdate
+// compares during an update, are not checked; see serverFields.
+package driftdetector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/gravity/lib/defaults"
+	"github.com/gravitational/gravity/lib/schema"
+	"github.com/gravitational/gravity/lib/storage"
+	"github.com/gravitational/gravity/lib/update"
+	"github.com/gravitational/gravity/lib/utils"
+
+	"github.com/cenkalti/backoff"
+	"github.com/gravitational/trace"
+	"github.com/sirupsen/logrus"
+)
+
+// Resolver attempts to auto-remediate a drift event. It returns whether
+// it handled the event; unhandled events fall through to the next
+// resolver, or are simply recorded if none handle it.
+type Resolver interface {
+	Resolve(ctx context.Context, event storage.DriftEvent) (resolved bool, err error)
+}
+
+// ResolverFunc adapts a plain function to a Resolver.
+type ResolverFunc func(ctx context.Context, event storage.DriftEvent) (bool, error)
+
+// Resolve calls f.
+func (f ResolverFunc) Resolve(ctx context.Context, event storage.DriftEvent) (bool, error) {
+	return f(ctx, event)
+}
+
+// Config is the configuration for a Detector.
+type Config struct {
+	// Backend gives access to the active operation plan and persists
+	// detected drift events. It doubles as the storage.DriftStore so
+	// events recorded here are guaranteed to be read back from the same
+	// store by update.GetOperationPlan, instead of two independently
+	// configured fields silently pointing at different backends.
+	Backend storage.Backend
+	// FieldLogger is used for logging.
+	FieldLogger logrus.FieldLogger
+	// CheckInterval is how often the detector polls node state.
+	CheckInterval time.Duration
+	// DebounceThreshold is the number of consecutive checks a field must
+	// disagree with the plan before it is reported, to avoid flapping on
+	// a single slow or transient observation.
+	DebounceThreshold int
+	// Resolvers are consulted in order for each event that clears the
+	// debounce threshold, stopping at the first one that resolves it.
+	Resolvers []Resolver
+}
+
+// checkAndSetDefaults validates the config and sets default values.
+func (c *Config) checkAndSetDefaults() error {
+	if c.Backend == nil {
+		return trace.BadParameter("Backend is required")
+	}
+	if c.FieldLogger == nil {
+		c.FieldLogger = logrus.WithField(trace.Component, "driftdetector")
+	}
+	if c.CheckInterval == 0 {
+		c.CheckInterval = defaults.DriftCheckInterval
+	}
+	if c.DebounceThreshold == 0 {
+		c.DebounceThreshold = 3
+	}
+	return nil
+}
+
+// Detector runs the drift detection loop.
+type Detector struct {
+	Config
+	// mu protects counts.
+	mu sync.Mutex
+	// counts tracks how many consecutive checks observed drift for a
+	// given server/field pair, keyed by driftKey.
+	counts map[string]int
+}
+
+// New returns a new Detector.
+func New(config Config) (*Detector, error) {
+	if err := config.checkAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &Detector{
+		Config: config,
+		counts: make(map[string]int),
+	}, nil
+}
+
+// Run starts the detector's check loop. It blocks until ctx is canceled.
+func (d *Detector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := d.check(ctx); err != nil {
+				d.WithError(err).Warn("Drift check failed.")
+			}
+		}
+	}
+}
+
+// check compares the live state of every server in the active plan
+// against what the plan expects, one field at a time.
+func (d *Detector) check(ctx context.Context) error {
+	// ignoreLicenseWarnings is hardcoded true here, not wired to a CLI
+	// flag: this check runs unattended in the background with no operator
+	// present to act on an unacknowledged Blocker warning, so it must not
+	// fail closed on one. See GetOperationPlan's doc comment - a future
+	// operator-invoked caller must plumb its own --ignore-license-warnings
+	// choice through instead of copying this true.
+	plan, err := update.GetOperationPlan(d.Backend, true)
+	if err != nil {
+		if trace.IsNotFound(err) {
+			// No active operation, nothing to compare against.
+			return nil
+		}
+		return trace.Wrap(err)
+	}
+	for _, server := range plan.Servers {
+		if err := d.checkServer(ctx, plan, server); err != nil {
+			d.WithError(err).Warnf("Failed to check drift on %v.", server.Hostname)
+		}
+	}
+	return nil
+}
+
+// serverField is one aspect of a server's live state that can drift from
+// what the plan expects. Adding a new field to check - e.g. the running
+// planet or teleport package version - means adding an entry here, not
+// changing checkServer's control flow.
+type serverField struct {
+	name     string
+	expected func(server storage.Server) (string, error)
+	observe  func(ctx context.Context, logger logrus.FieldLogger, plan *storage.OperationPlan, server storage.Server) (string, error)
+}
+
+// serverFields lists every field checkServer compares against the plan.
+//
+// Only "election" is listed: it runs the planet "leader status" command
+// on the node. Profiles and runtime/teleport package versions are not
+// compared, since nothing here queries a running node for them. A check
+// for one of them is another serverField entry here; checkServer feeds
+// it to observe() and the resolver chain the same way as "election".
+var serverFields = []serverField{
+	{
+		name: "election",
+		expected: func(server storage.Server) (string, error) {
+			return boolString(expectedElectionEnabled(server)), nil
+		},
+		observe: func(ctx context.Context, logger logrus.FieldLogger, plan *storage.OperationPlan, server storage.Server) (string, error) {
+			actual, err := observeElectionEnabled(ctx, logger, plan, server)
+			if err != nil {
+				return "", trace.Wrap(err)
+			}
+			return boolString(actual), nil
+		},
+	},
+}
+
+func (d *Detector) checkServer(ctx context.Context, plan *storage.OperationPlan, server storage.Server) error {
+	var errors []error
+	for _, field := range serverFields {
+		expected, err := field.expected(server)
+		if err != nil {
+			errors = append(errors, trace.Wrap(err))
+			continue
+		}
+		actual, err := field.observe(ctx, d.FieldLogger, plan, server)
+		if err != nil {
+			errors = append(errors, trace.Wrap(err))
+			continue
+		}
+		d.observe(ctx, server, field.name, expected, actual)
+	}
+	return trace.NewAggregate(errors...)
+}
+
+// observe records one field's observation, reporting and (optionally)
+// resolving a DriftEvent once it has persisted for DebounceThreshold
+// consecutive checks, and resetting the debounce counter otherwise.
+func (d *Detector) observe(ctx context.Context, server storage.Server, field, expected, actual string) {
+	key := server.AdvertiseIP + "/" + field
+	d.mu.Lock()
+	if expected == actual {
+		delete(d.counts, key)
+		d.mu.Unlock()
+		return
+	}
+	d.counts[key]++
+	count := d.counts[key]
+	d.mu.Unlock()
+
+	if count < d.DebounceThreshold {
+		return
+	}
+
+	event := storage.DriftEvent{
+		Server:     server,
+		Field:      field,
+		Expected:   expected,
+		Actual:     actual,
+		DetectedAt: time.Now().UTC(),
+	}
+	if err := d.Backend.RecordDriftEvent(event); err != nil {
+		d.WithError(err).Warn("Failed to record drift event.")
+		return
+	}
+	d.WithFields(logrus.Fields{
+		"server": server.Hostname,
+		"field":  field,
+	}).Warnf("Detected drift: expected %v, got %v.", expected, actual)
+
+	for _, resolver := range d.Resolvers {
+		resolved, err := resolver.Resolve(ctx, event)
+		if err != nil {
+			d.WithError(err).Warn("Drift resolver failed.")
+			continue
+		}
+		if resolved {
+			d.mu.Lock()
+			delete(d.counts, key)
+			d.mu.Unlock()
+			break
+		}
+	}
+}
+
+// expectedElectionEnabled reports whether server, as described by the
+// plan, is expected to have leader elections enabled: all master nodes
+// should, per the enableElection phase.
+func expectedElectionEnabled(server storage.Server) bool {
+	return server.ClusterRole == string(schema.ServiceRoleMaster)
+}
+
+// observeElectionEnabled queries the live election status on server,
+// the same way enableElectionExecutor.resumeLeader does to enable it.
+func observeElectionEnabled(ctx context.Context, logger logrus.FieldLogger, plan *storage.OperationPlan, server storage.Server) (bool, error) {
+	out, err := utils.RunPlanetCommand(
+		ctx,
+		logger,
+		"leader",
+		"status",
+		fmt.Sprintf("--public-ip=%v", server.AdvertiseIP),
+		fmt.Sprintf("--election-key=/planet/cluster/%v/election", plan.ClusterName),
+		"--etcd-cafile=/var/state/root.cert",
+		"--etcd-certfile=/var/state/etcd.cert",
+		"--etcd-keyfile=/var/state/etcd.key",
+	)
+	if err != nil {
+		return false, trace.Wrap(err, "failed to query election status for %v: %s",
+			server.AdvertiseIP, string(out))
+	}
+	return strings.TrimSpace(string(out)) == "enabled", nil
+}
+
+func boolString(v bool) string {
+	if v {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// NewElectionResolver returns a Resolver that re-enables leader
+// elections on a master whose election was found disabled, mirroring
+// the enableElection phase's own remediation so routine drift
+// self-heals without operator involvement. clusterName identifies the
+// etcd election key, as it does for enableElectionExecutor.
+func NewElectionResolver(clusterName string) Resolver {
+	return ResolverFunc(func(ctx context.Context, event storage.DriftEvent) (bool, error) {
+		if event.Field != "election" || event.Expected != "enabled" {
+			return false, nil
+		}
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = defaults.ElectionWaitTimeout
+		err := utils.RetryTransient(ctx, b, func() error {
+			_, err := utils.RunPlanetCommand(
+				ctx,
+				logrus.WithField(trace.Component, "driftdetector"),
+				"leader",
+				"resume",
+				fmt.Sprintf("--public-ip=%v", event.Server.AdvertiseIP),
+				fmt.Sprintf("--election-key=/planet/cluster/%v/election", clusterName),
+				"--etcd-cafile=/var/state/root.cert",
+				"--etcd-certfile=/var/state/etcd.cert",
+				"--etcd-keyfile=/var/state/etcd.key",
+			)
+			return trace.Wrap(err)
+		})
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		return true, nil
+	})
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetector
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/gravitational/gravity/lib/storage"
+)
+
+func TestObserveDebouncesBeforeReporting(t *testing.T) {
+	backend := newFakeBackend()
+	d := newTestDetector(t, Config{Backend: backend, DebounceThreshold: 3})
+	server := storage.Server{AdvertiseIP: "10.0.0.1", Hostname: "node-1"}
+
+	d.observe(context.Background(), server, "election", "enabled", "disabled")
+	d.observe(context.Background(), server, "election", "enabled", "disabled")
+	if len(backend.recorded()) != 0 {
+		t.Fatalf("expected no drift event before the debounce threshold, got %+v", backend.recorded())
+	}
+
+	d.observe(context.Background(), server, "election", "enabled", "disabled")
+	events := backend.recorded()
+	if len(events) != 1 {
+		t.Fatalf("expected exactly one drift event once the threshold is reached, got %+v", events)
+	}
+	if events[0].Field != "election" || events[0].Expected != "enabled" || events[0].Actual != "disabled" {
+		t.Fatalf("unexpected drift event: %+v", events[0])
+	}
+}
+
+func TestObserveResetsCountOnMatch(t *testing.T) {
+	backend := newFakeBackend()
+	d := newTestDetector(t, Config{Backend: backend, DebounceThreshold: 2})
+	server := storage.Server{AdvertiseIP: "10.0.0.1", Hostname: "node-1"}
+
+	d.observe(context.Background(), server, "election", "enabled", "disabled")
+	d.observe(context.Background(), server, "election", "enabled", "enabled")
+	d.observe(context.Background(), server, "election", "enabled", "disabled")
+	if len(backend.recorded()) != 0 {
+		t.Fatalf("expected the intervening match to reset the debounce count, got %+v", backend.recorded())
+	}
+}
+
+func TestObserveResolverClearsCount(t *testing.T) {
+	backend := newFakeBackend()
+	resolver := &fakeResolver{resolved: true}
+	d := newTestDetector(t, Config{Backend: backend, DebounceThreshold: 1, Resolvers: []Resolver{resolver}})
+	server := storage.Server{AdvertiseIP: "10.0.0.1", Hostname: "node-1"}
+	key := server.AdvertiseIP + "/election"
+
+	d.observe(context.Background(), server, "election", "enabled", "disabled")
+	if resolver.calls != 1 {
+		t.Fatalf("expected the resolver to be consulted once, got %v calls", resolver.calls)
+	}
+	if _, ok := d.counts[key]; ok {
+		t.Fatalf("expected the debounce count to be cleared once a resolver resolves the event")
+	}
+}
+
+func TestObserveResolverFallthrough(t *testing.T) {
+	backend := newFakeBackend()
+	first := &fakeResolver{resolved: false}
+	second := &fakeResolver{resolved: true}
+	third := &fakeResolver{resolved: true}
+	d := newTestDetector(t, Config{
+		Backend:           backend,
+		DebounceThreshold: 1,
+		Resolvers:         []Resolver{first, second, third},
+	})
+	server := storage.Server{AdvertiseIP: "10.0.0.1", Hostname: "node-1"}
+
+	d.observe(context.Background(), server, "election", "enabled", "disabled")
+	if first.calls != 1 || second.calls != 1 {
+		t.Fatalf("expected both first and second resolvers to be consulted, got first=%v second=%v",
+			first.calls, second.calls)
+	}
+	if third.calls != 0 {
+		t.Fatalf("expected the resolver chain to stop at the first resolver that resolves the event")
+	}
+}
+
+func newTestDetector(t *testing.T, config Config) *Detector {
+	t.Helper()
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return d
+}
+
+// fakeBackend embeds storage.Backend so it satisfies the (much larger)
+// interface without implementing every method - observe only ever calls
+// RecordDriftEvent, so that's the only one this test double overrides.
+type fakeBackend struct {
+	storage.Backend
+	mu     sync.Mutex
+	events []storage.DriftEvent
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{}
+}
+
+func (f *fakeBackend) RecordDriftEvent(event storage.DriftEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *fakeBackend) recorded() []storage.DriftEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]storage.DriftEvent(nil), f.events...)
+}
+
+// fakeResolver is a Resolver that always returns the configured outcome,
+// counting how many times it was consulted.
+type fakeResolver struct {
+	resolved bool
+	calls    int
+}
+
+func (f *fakeResolver) Resolve(ctx context.Context, event storage.DriftEvent) (bool, error) {
+	f.calls++
+	return f.resolved, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"fmt"
+	"time"
+
+	appservice "github.com/gravitational/gravity/lib/app"
+	"github.com/gravitational/gravity/lib/defaults"
+	"github.com/gravitational/gravity/lib/license"
+	"github.com/gravitational/gravity/lib/storage"
+
+	"github.com/gravitational/trace"
+)
+
+// LicensePreflight evaluates whether moving from installed to update
+// would violate the cluster's currently installed license and returns a
+// warning for each issue found. It does not itself block the update -
+// callers decide based on each warning's Severity, e.g. GetOperationPlan
+// returns an error alongside a plan with an unacknowledged Blocker
+// warning.
+func LicensePreflight(installed, update appservice.Application) ([]storage.LicenseWarning, error) {
+	lic, err := license.ParseLicense(license.GetPayload())
+	if err != nil {
+		if trace.IsNotFound(err) {
+			// No license installed, e.g. an open-source cluster - there
+			// is nothing to check compliance against.
+			return nil, nil
+		}
+		return nil, trace.Wrap(err)
+	}
+
+	var warnings []storage.LicenseWarning
+	if warning := checkLicenseNodeCount(lic, update); warning != nil {
+		warnings = append(warnings, *warning)
+	}
+	if warning := checkLicenseExpiration(lic); warning != nil {
+		warnings = append(warnings, *warning)
+	}
+	warnings = append(warnings, checkLicenseFeatures(lic, installed, update)...)
+	return warnings, nil
+}
+
+func checkLicenseNodeCount(lic license.License, update appservice.Application) *storage.LicenseWarning {
+	if lic.Payload.MaxNodes <= 0 {
+		return nil
+	}
+	var total int
+	for _, profile := range update.Manifest.NodeProfiles {
+		total += profile.Count
+	}
+	if total <= lic.Payload.MaxNodes {
+		return nil
+	}
+	return &storage.LicenseWarning{
+		Severity: storage.LicenseWarningBlocker,
+		Code:     "node-count-exceeded",
+		Message: fmt.Sprintf(
+			"cluster node count exceeds licensed maximum (%v) after this update (%v nodes)",
+			lic.Payload.MaxNodes, total),
+	}
+}
+
+func checkLicenseExpiration(lic license.License) *storage.LicenseWarning {
+	if lic.Payload.Expiration.IsZero() {
+		return nil
+	}
+	remaining := time.Until(lic.Payload.Expiration)
+	switch {
+	case remaining <= 0:
+		return &storage.LicenseWarning{
+			Severity: storage.LicenseWarningBlocker,
+			Code:     "license-expired",
+			Message:  "installed license has already expired",
+		}
+	case remaining < defaults.UpdateTimeout:
+		return &storage.LicenseWarning{
+			Severity: storage.LicenseWarningWarning,
+			Code:     "license-expires-during-update",
+			Message: fmt.Sprintf(
+				"license expires in %v, which may be before the update completes",
+				remaining.Round(time.Minute)),
+		}
+	}
+	return nil
+}
+
+func checkLicenseFeatures(lic license.License, installed, update appservice.Application) []storage.LicenseWarning {
+	var warnings []storage.LicenseWarning
+	for _, profile := range update.Manifest.NodeProfiles {
+		if _, err := installed.Manifest.NodeProfiles.ByName(profile.Name); err == nil {
+			// Not a new profile introduced by this update.
+			continue
+		}
+		if lic.Payload.Features[profile.Name] {
+			continue
+		}
+		warnings = append(warnings, storage.LicenseWarning{
+			Severity: storage.LicenseWarningWarning,
+			Code:     "feature-not-licensed",
+			Message: fmt.Sprintf(
+				"update introduces profile %q which is not covered by the installed license",
+				profile.Name),
+		})
+	}
+	return warnings
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"testing"
+	"time"
+
+	appservice "github.com/gravitational/gravity/lib/app"
+	"github.com/gravitational/gravity/lib/license"
+	"github.com/gravitational/gravity/lib/schema"
+	"github.com/gravitational/gravity/lib/storage"
+)
+
+func TestCheckLicenseNodeCountUnlimited(t *testing.T) {
+	lic := license.License{Payload: license.Payload{MaxNodes: 0}}
+	update := appWithProfiles(schema.NodeProfile{Name: "worker", Count: 100})
+	if warning := checkLicenseNodeCount(lic, update); warning != nil {
+		t.Fatalf("expected no warning for an unlimited license, got %+v", warning)
+	}
+}
+
+func TestCheckLicenseNodeCountWithinLimit(t *testing.T) {
+	lic := license.License{Payload: license.Payload{MaxNodes: 5}}
+	update := appWithProfiles(schema.NodeProfile{Name: "worker", Count: 5})
+	if warning := checkLicenseNodeCount(lic, update); warning != nil {
+		t.Fatalf("expected no warning at exactly the licensed node count, got %+v", warning)
+	}
+}
+
+func TestCheckLicenseNodeCountExceeded(t *testing.T) {
+	lic := license.License{Payload: license.Payload{MaxNodes: 3}}
+	update := appWithProfiles(schema.NodeProfile{Name: "worker", Count: 4})
+	warning := checkLicenseNodeCount(lic, update)
+	if warning == nil {
+		t.Fatal("expected a warning when node count exceeds the license")
+	}
+	if warning.Severity != storage.LicenseWarningBlocker {
+		t.Fatalf("expected a blocker warning, got severity %v", warning.Severity)
+	}
+	if warning.Code != "node-count-exceeded" {
+		t.Fatalf("expected code node-count-exceeded, got %v", warning.Code)
+	}
+}
+
+func TestCheckLicenseExpirationNoExpiration(t *testing.T) {
+	lic := license.License{}
+	if warning := checkLicenseExpiration(lic); warning != nil {
+		t.Fatalf("expected no warning for a license with no expiration, got %+v", warning)
+	}
+}
+
+func TestCheckLicenseExpirationAlreadyExpired(t *testing.T) {
+	lic := license.License{Payload: license.Payload{Expiration: time.Now().Add(-time.Hour)}}
+	warning := checkLicenseExpiration(lic)
+	if warning == nil {
+		t.Fatal("expected a warning for an already-expired license")
+	}
+	if warning.Severity != storage.LicenseWarningBlocker {
+		t.Fatalf("expected a blocker warning, got severity %v", warning.Severity)
+	}
+	if warning.Code != "license-expired" {
+		t.Fatalf("expected code license-expired, got %v", warning.Code)
+	}
+}
+
+func TestCheckLicenseExpirationDuringUpdate(t *testing.T) {
+	lic := license.License{Payload: license.Payload{Expiration: time.Now().Add(time.Minute)}}
+	warning := checkLicenseExpiration(lic)
+	if warning == nil {
+		t.Fatal("expected a warning for a license expiring shortly")
+	}
+	if warning.Severity != storage.LicenseWarningWarning {
+		t.Fatalf("expected a non-blocking warning, got severity %v", warning.Severity)
+	}
+	if warning.Code != "license-expires-during-update" {
+		t.Fatalf("expected code license-expires-during-update, got %v", warning.Code)
+	}
+}
+
+func TestCheckLicenseExpirationFarInFuture(t *testing.T) {
+	lic := license.License{Payload: license.Payload{Expiration: time.Now().Add(365 * 24 * time.Hour)}}
+	if warning := checkLicenseExpiration(lic); warning != nil {
+		t.Fatalf("expected no warning for a license nowhere near expiring, got %+v", warning)
+	}
+}
+
+func TestCheckLicenseFeaturesWarnsOnUnlicensedNewProfile(t *testing.T) {
+	installed := appWithProfiles()
+	update := appWithProfiles(schema.NodeProfile{Name: "gpu"})
+	lic := license.License{Payload: license.Payload{Features: map[string]bool{}}}
+	warnings := checkLicenseFeatures(lic, installed, update)
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning for the unlicensed new profile, got %+v", warnings)
+	}
+	if warnings[0].Code != "feature-not-licensed" {
+		t.Fatalf("expected code feature-not-licensed, got %v", warnings[0].Code)
+	}
+}
+
+func TestCheckLicenseFeaturesAllowsLicensedNewProfile(t *testing.T) {
+	installed := appWithProfiles()
+	update := appWithProfiles(schema.NodeProfile{Name: "gpu"})
+	lic := license.License{Payload: license.Payload{Features: map[string]bool{"gpu": true}}}
+	warnings := checkLicenseFeatures(lic, installed, update)
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings for a licensed new profile, got %+v", warnings)
+	}
+}
+
+func TestCheckLicenseFeaturesIgnoresExistingProfile(t *testing.T) {
+	installed := appWithProfiles(schema.NodeProfile{Name: "worker"})
+	update := appWithProfiles(schema.NodeProfile{Name: "worker"})
+	lic := license.License{Payload: license.Payload{Features: map[string]bool{}}}
+	warnings := checkLicenseFeatures(lic, installed, update)
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings for a profile already present before the update, got %+v", warnings)
+	}
+}
+
+func appWithProfiles(profiles ...schema.NodeProfile) appservice.Application {
+	return appservice.Application{
+		Manifest: schema.Manifest{
+			NodeProfiles: schema.NodeProfiles(profiles),
+		},
+	}
+}
@@ -28,8 +28,19 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// GetOperationPlan returns an up-to-date operation plan
-func GetOperationPlan(b storage.Backend) (*storage.OperationPlan, error) {
+// GetOperationPlan returns an up-to-date operation plan. If the plan
+// carries an unacknowledged license Blocker warning, it is returned
+// alongside a non-nil error unless ignoreLicenseWarnings is set.
+// ignoreLicenseWarnings must be threaded from an operator's explicit
+// choice to proceed anyway (e.g. an --ignore-license-warnings CLI flag on
+// whatever command surfaces this error to a human) - it must not be
+// hardcoded true by a caller that never gives the operator a chance to
+// see the warning first. driftdetector.check is presently this
+// function's only caller, and passes true unconditionally because it is
+// a passive, non-blocking background check with no operator attached to
+// prompt; that is a deliberate exception to the rule above, not the
+// pattern for a future command-driven caller to copy.
+func GetOperationPlan(b storage.Backend, ignoreLicenseWarnings bool) (*storage.OperationPlan, error) {
 	op, err := storage.GetLastOperation(b)
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -51,13 +62,42 @@ func GetOperationPlan(b storage.Backend) (*storage.OperationPlan, error) {
 	}
 
 	plan = fsm.ResolvePlan(*plan, changelog)
+	if err := checkLicenseWarnings(plan.LicenseWarnings, ignoreLicenseWarnings); err != nil {
+		return plan, trace.Wrap(err)
+	}
+
+	drift, err := b.GetDriftEvents(op.SiteDomain)
+	if err != nil && !trace.IsNotFound(err) {
+		logrus.Warnf("Failed to fetch drift events: %v.", err)
+	}
+	plan.Drift = drift
+
 	return plan, nil
 }
 
+// checkLicenseWarnings returns an error if warnings contains an
+// unacknowledged Blocker-severity entry.
+func checkLicenseWarnings(warnings []storage.LicenseWarning, ignore bool) error {
+	if ignore {
+		return nil
+	}
+	for _, warning := range warnings {
+		if warning.Severity == storage.LicenseWarningBlocker {
+			return trace.BadParameter(
+				"%v: %v (rerun with --ignore-license-warnings to proceed anyway)",
+				warning.Code, warning.Message)
+		}
+	}
+	return nil
+}
+
 // systemNeedsUpdate determines whether planet or teleport services need
 // to be updated by comparing versions of respective packages in the
-// installed and update application manifest
-func systemNeedsUpdate(profile string, installed, update appservice.Application) (planetNeedsUpdate, teleportNeedsUpdate bool, err error) {
+// installed and update application manifest. It also runs the license
+// compliance preflight for the version bump and records any warnings on
+// plan, the same way GetOperationPlan assigns plan.Drift, so
+// GetOperationPlan's Blocker check has something to see.
+func systemNeedsUpdate(plan *storage.OperationPlan, profile string, installed, update appservice.Application) (planetNeedsUpdate, teleportNeedsUpdate bool, err error) {
 	installedProfile, err := installed.Manifest.NodeProfiles.ByName(profile)
 	if err != nil {
 		return false, false, trace.Wrap(err)
@@ -116,6 +156,12 @@ func systemNeedsUpdate(profile string, installed, update appservice.Application)
 	logrus.Debugf("Teleport installed: %v, teleport update: %v.",
 		installedTeleportPackage, updateTeleportPackage)
 
+	warnings, err := LicensePreflight(installed, update)
+	if err != nil {
+		return false, false, trace.Wrap(err)
+	}
+	plan.LicenseWarnings = warnings
+
 	return installedRuntimeVersion.LessThan(*updateRuntimeVersion),
 		installedTeleportVersion.LessThan(*updateTeleportVersion), nil
 }